@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testProbeHost = "ipv6.probe.test"
+
+// fakeUpstream 模拟检测目标：httpbin.org 像 /get 一样返回出口IP和收到的请求头，探测地址返回 probeBody 并统计请求次数
+type fakeUpstream struct {
+	exitIP     string
+	exitDelay  time.Duration
+	probeBody  string
+	probeDelay time.Duration
+	probeHits  atomic.Int32
+
+	exitGate chan struct{} // 不为 nil 时检测请求阻塞到通道关闭
+
+	mu       sync.Mutex
+	exitHits []time.Time // 检测请求到达的时间
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var body string
+	switch host {
+	case "httpbin.org":
+		u.mu.Lock()
+		u.exitHits = append(u.exitHits, time.Now())
+		u.mu.Unlock()
+		if u.exitGate != nil {
+			<-u.exitGate
+		}
+		time.Sleep(u.exitDelay)
+		headers := make(map[string]string)
+		for name := range r.Header {
+			headers[name] = r.Header.Get(name)
+		}
+		data, _ := json.Marshal(map[string]interface{}{"origin": u.exitIP, "headers": headers})
+		body = string(data)
+	case testProbeHost:
+		u.probeHits.Add(1)
+		select {
+		case <-time.After(u.probeDelay):
+		case <-r.Context().Done():
+			return
+		}
+		body = u.probeBody
+	default:
+		http.Error(w, "unknown host", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	io.WriteString(w, body)
+}
+
+// listenIPv6Loopback 在 [::1] 上监听随机端口，环境不支持IPv6时跳过测试
+func listenIPv6Loopback(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 回环地址不可用: %v", err)
+	}
+	return ln
+}
+
+// startHTTPProxy 启动监听 [::1] 的 HTTP 代理，请求直接交给 upstream 处理而不访问外网
+func startHTTPProxy(t *testing.T, upstream http.Handler) string {
+	t.Helper()
+	srv := &httptest.Server{
+		Listener: listenIPv6Loopback(t),
+		Config:   &http.Server{Handler: upstream},
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return "http://" + srv.Listener.Addr().String()
+}
+
+// startSOCKS5Proxy 启动监听 [::1] 的无认证 SOCKS5 代理，CONNECT 后的 HTTP 请求直接交给 upstream 处理
+func startSOCKS5Proxy(t *testing.T, upstream http.Handler) string {
+	t.Helper()
+	ln := listenIPv6Loopback(t)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5Conn(conn, upstream)
+		}
+	}()
+	return "socks5://" + ln.Addr().String()
+}
+
+func serveSOCKS5Conn(conn net.Conn, upstream http.Handler) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// 协商认证方式：只支持无认证
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(br, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	// CONNECT 请求：忽略目标地址，由 upstream 按 Host 头应答
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(br, request); err != nil || request[1] != 1 {
+		return
+	}
+	var addrLen int
+	switch request[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		addrLen = int(n)
+	default:
+		return
+	}
+	if _, err := io.ReadFull(br, make([]byte, addrLen+2)); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		rec := httptest.NewRecorder()
+		upstream.ServeHTTP(rec, req)
+		if err := rec.Result().Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+// withTestConfig 设置检测所需的配置，测试结束后恢复
+func withTestConfig(t *testing.T, probe bool) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.Settings.CheckTimeout = 5
+	config.Settings.IPv6Probe = probe
+	config.Settings.IPv6ProbeURL = "http://" + testProbeHost + "/"
+	config.Settings.IPv6ProbeTimeout = 2
+	// 测试代理监听在回环地址上，需要放开内网地址保护
+	config.Settings.AllowPrivateProxies = true
+	config.IPDetection.Enabled = false
+}
+
+func TestCheckProxyIPv6Probe(t *testing.T) {
+	tests := []struct {
+		name         string
+		scheme       string
+		exitIP       string
+		probeBody    string
+		probe        bool
+		wantSupports bool
+		wantIPv6Exit string
+		wantHits     int32
+	}{
+		{"HTTP 代理探测成功", "http", "203.0.113.7", `{"ip": "2001:db8::1"}`, true, true, "2001:db8::1", 1},
+		{"SOCKS5 代理探测成功", "socks5", "203.0.113.7", `{"ip": "2001:db8::1"}`, true, true, "2001:db8::1", 1},
+		{"探测返回IPv4视为不支持", "socks5", "203.0.113.7", `{"ip": "198.51.100.1"}`, true, false, "", 1},
+		{"探测地址返回非IP内容", "http", "203.0.113.7", `not an ip`, true, false, "", 1},
+		{"出口为IPv6时不额外探测", "http", "2001:db8::2", `{"ip": "2001:db8::1"}`, true, true, "2001:db8::2", 0},
+		{"未开启探测", "socks5", "203.0.113.7", `{"ip": "2001:db8::1"}`, false, false, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTestConfig(t, tt.probe)
+			upstream := &fakeUpstream{exitIP: tt.exitIP, probeBody: tt.probeBody}
+
+			proxyInfo := &ProxyInfo{Protocol: "http"}
+			if tt.scheme == "socks5" {
+				proxyInfo.URL = startSOCKS5Proxy(t, upstream)
+				proxyInfo.Protocol = "socks5_noauth"
+			} else {
+				proxyInfo.URL = startHTTPProxy(t, upstream)
+			}
+
+			result := checkProxy(t.Context(), proxyInfo)
+			if !result.Success {
+				t.Fatalf("检测失败: %s", result.Reason)
+			}
+			if result.IP != tt.exitIP {
+				t.Errorf("IP = %q, want %q", result.IP, tt.exitIP)
+			}
+			if result.SupportsIPv6 != tt.wantSupports {
+				t.Errorf("SupportsIPv6 = %v, want %v", result.SupportsIPv6, tt.wantSupports)
+			}
+			if result.IPv6Exit != tt.wantIPv6Exit {
+				t.Errorf("IPv6Exit = %q, want %q", result.IPv6Exit, tt.wantIPv6Exit)
+			}
+			if hits := upstream.probeHits.Load(); hits != tt.wantHits {
+				t.Errorf("探测请求 %d 次, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestCheckProxyIPv6ProbeTimeout(t *testing.T) {
+	withTestConfig(t, true)
+	config.Settings.CheckTimeout = 10
+	config.Settings.IPv6ProbeTimeout = 1
+	upstream := &fakeUpstream{exitIP: "203.0.113.7", probeBody: `{"ip": "2001:db8::1"}`, probeDelay: 5 * time.Second}
+
+	start := time.Now()
+	result := checkProxy(t.Context(), &ProxyInfo{URL: startHTTPProxy(t, upstream), Protocol: "http"})
+	elapsed := time.Since(start)
+
+	if !result.Success {
+		t.Fatalf("检测失败: %s", result.Reason)
+	}
+	if result.SupportsIPv6 {
+		t.Error("探测超时的代理不应标记为支持IPv6")
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("探测耗时 %v，未使用 ipv6_probe_timeout", elapsed)
+	}
+}
+
+func TestCheckProxyRejectsLoopbackByDefault(t *testing.T) {
+	withTestConfig(t, true)
+	config.Settings.AllowPrivateProxies = false
+	upstream := &fakeUpstream{exitIP: "203.0.113.7", probeBody: `{"ip": "2001:db8::1"}`}
+
+	result := checkProxy(t.Context(), &ProxyInfo{URL: startSOCKS5Proxy(t, upstream), Protocol: "socks5_noauth"})
+	if result.Success {
+		t.Fatal("未开启 allow_private_proxies 时不应连接回环地址的代理")
+	}
+	if !strings.Contains(normalizeFailureReason(result.Reason), "内网地址") {
+		t.Errorf("失败原因 = %q", result.Reason)
+	}
+	if hits := upstream.probeHits.Load(); hits != 0 {
+		t.Errorf("探测请求 %d 次, want 0", hits)
+	}
+}
+
+func TestInternalAddressKind(t *testing.T) {
+	tests := []struct {
+		ip       string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"169.254.1.1", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"::ffff:100.64.0.1", true},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		{"8.8.8.8", false},
+		{"2001:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if kind := internalAddressKind(net.ParseIP(tt.ip)); (kind != "") != tt.internal {
+			t.Errorf("internalAddressKind(%s) = %q, want internal=%v", tt.ip, kind, tt.internal)
+		}
+	}
+}
+
+func TestRunProxyTestsAccountsForEveryProxy(t *testing.T) {
+	const total = 200
+
+	// cancelAfter 为 0 时不取消，消费方较慢时也必须收到每个代理的结果
+	for _, cancelAfter := range []int{0, 20} {
+		for _, adaptive := range []bool{false, true} {
+			t.Run(fmt.Sprintf("cancelAfter=%d/adaptive=%v", cancelAfter, adaptive), func(t *testing.T) {
+				testRunProxyTestsAccounting(t, total, cancelAfter, adaptive)
+			})
+		}
+	}
+}
+
+func testRunProxyTestsAccounting(t *testing.T, total, cancelAfter int, adaptive bool) {
+	withTestConfig(t, false)
+	config.Settings.MaxConcurrent = 8
+	config.Concurrency.Adaptive = adaptive
+	config.Concurrency.Min = 2
+	config.Concurrency.Step = 2
+	config.Concurrency.Interval = 1
+	config.Concurrency.ErrorRate = 0.05
+	config.Concurrency.FDRatio = 0.8
+	upstream := &fakeUpstream{exitIP: "203.0.113.7", exitDelay: 5 * time.Millisecond}
+	proxyURL := startHTTPProxy(t, upstream)
+
+	proxiesChan := make(chan *ProxyInfo)
+	go func() {
+		defer close(proxiesChan)
+		for i := 0; i < total; i++ {
+			proxiesChan <- &ProxyInfo{URL: proxyURL, Protocol: "http", Source: fmt.Sprint(i)}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := runProxyTests(ctx, proxiesChan)
+
+	received := 0
+	seen := make(map[string]bool)
+	for result := range pool.GetResults() {
+		received++
+		if seen[result.Source] {
+			t.Errorf("代理 %s 返回了重复的结果", result.Source)
+		}
+		seen[result.Source] = true
+		if !result.Success {
+			t.Errorf("代理 %s 检测失败: %s", result.Source, result.Reason)
+		}
+		if cancelAfter > 0 && received == cancelAfter {
+			cancel()
+		}
+		// 模拟处理较慢的消费方：不取消时结果通道反压也不能丢失结果，取消时仍有任务排队
+		time.Sleep(time.Millisecond)
+	}
+
+	var stats PipelineStats
+	pool.fillStats(&stats)
+	t.Logf("提交 %d 个，返回 %d 条结果，取消 %d 个", stats.Submitted, stats.Tested, stats.Cancelled)
+	if stats.Submitted != stats.Tested+stats.Cancelled {
+		t.Errorf("提交 %d 个，返回 %d 条结果，取消 %d 个", stats.Submitted, stats.Tested, stats.Cancelled)
+	}
+	if received != stats.Tested {
+		t.Errorf("收到 %d 条结果，工作池计数 %d 条", received, stats.Tested)
+	}
+	if cancelAfter == 0 {
+		if stats.Cancelled != 0 || stats.Submitted != total || stats.Tested != total || received != total {
+			t.Errorf("未取消: 提交 %d 个，返回 %d 条结果，取消 %d 个，收到 %d 条，期望全部 %d 个", stats.Submitted, stats.Tested, stats.Cancelled, received, total)
+		}
+		return
+	}
+	if received < cancelAfter || stats.Submitted > total {
+		t.Errorf("收到 %d 条结果，提交 %d 个", received, stats.Submitted)
+	}
+	if stats.Submitted == total && stats.Cancelled == 0 {
+		t.Error("取消后仍检测了全部代理")
+	}
+}
+
+func TestCheckpointAppendsResultsAndResumes(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Settings.OutputDir = t.TempDir()
+
+	queue := &checkQueue{Total: 3, Test: []*ProxyInfo{
+		{URL: "http://198.51.100.1:8080", Protocol: "http"},
+		{URL: "http://198.51.100.2:8080", Protocol: "http"},
+		{URL: "http://198.51.100.3:8080", Protocol: "http"},
+	}}
+	checkpoint := createCheckpoint(time.Now(), queue)
+	if checkpoint == nil {
+		t.Fatal("创建检查点失败")
+	}
+	queueData, err := os.ReadFile(checkpointPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次只追加新完成的结果，检测队列不重写
+	for _, p := range queue.Test[:2] {
+		checkpoint.record(ProxyResult{URL: p.URL, Protocol: p.Protocol, Success: true})
+		if !checkpoint.flush() {
+			t.Fatal("写入检查点结果失败")
+		}
+	}
+	if data, _ := os.ReadFile(checkpointPath()); !bytes.Equal(data, queueData) {
+		t.Error("写入结果时重写了检测队列")
+	}
+
+	// 模拟崩溃时写了一半的行
+	file, err := os.OpenFile(checkpointResultsPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"url":"http://198.51.100.3:80`)
+	file.Close()
+
+	loaded, err := loadCheckpoint()
+	if err != nil || loaded == nil {
+		t.Fatalf("读取检查点失败: %v", err)
+	}
+	if len(loaded.Results) != 2 {
+		t.Fatalf("读取到 %d 条结果，期望 2 条", len(loaded.Results))
+	}
+	pending := pendingCheckProxies(loaded.Queue.Test, loaded.Results)
+	if len(pending) != 1 || pending[0].URL != queue.Test[2].URL {
+		t.Fatalf("待检测代理 %v，期望只剩 %s", pending, queue.Test[2].URL)
+	}
+
+	// 恢复检测时已写入的结果不会重复追加，新结果从新的一行开始
+	loaded.record(loaded.Results[0])
+	if len(loaded.pending) != 0 {
+		t.Error("已写入的结果被重复记录")
+	}
+	loaded.record(ProxyResult{URL: queue.Test[2].URL, Protocol: "http"})
+	if !loaded.flush() {
+		t.Fatal("写入检查点结果失败")
+	}
+	if reloaded, err := loadCheckpoint(); err != nil || len(reloaded.Results) != 3 {
+		t.Fatalf("恢复后读取检查点失败: %v", err)
+	}
+
+	removeCheckpoint()
+	for _, path := range []string{checkpointPath(), checkpointResultsPath()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s 未被删除", path)
+		}
+	}
+}
+
+func TestClassifyAnonymity(t *testing.T) {
+	const exitIP = "203.0.113.7"
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no proxy headers", `{"origin": "203.0.113.7", "headers": {"Host": "httpbin.org"}}`, "elite"},
+		{"via", `{"origin": "203.0.113.7", "headers": {"Via": "1.1 squid"}}`, "anonymous"},
+		{"forwarded exit ip", `{"origin": "203.0.113.7", "headers": {"X-Forwarded-For": "203.0.113.7"}}`, "anonymous"},
+		{"forwarded client ip", `{"origin": "203.0.113.7", "headers": {"x-real-ip": "198.51.100.9"}}`, "transparent"},
+		{"forwarded header", `{"origin": "203.0.113.7", "headers": {"Forwarded": "for=\"198.51.100.9:4711\";by=203.0.113.7"}}`, "transparent"},
+		{"merged origin", `{"origin": "198.51.100.9, 203.0.113.7", "headers": {}}`, "transparent"},
+		{"no header echo", `{"origin": "203.0.113.7"}`, "unknown"},
+		{"not json", `203.0.113.7`, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyAnonymity(exitIP, []byte(tt.body)); got != tt.want {
+				t.Errorf("classifyAnonymity(%s) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckProxyClassifiesAnonymityFromEchoedHeaders(t *testing.T) {
+	withTestConfig(t, false)
+	upstream := &fakeUpstream{exitIP: "203.0.113.7"}
+	result := checkProxy(t.Context(), &ProxyInfo{URL: startHTTPProxy(t, upstream), Protocol: "http"})
+	if !result.Success {
+		t.Fatalf("检测失败: %s", result.Reason)
+	}
+	if result.Anonymity != "elite" {
+		t.Errorf("Anonymity = %q, want elite", result.Anonymity)
+	}
+}
+
+func TestRunProxyTestsSpacesChecksToSameHost(t *testing.T) {
+	const total = 8
+	const hostRate = 20
+
+	withTestConfig(t, false)
+	config.Settings.MaxConcurrent = 2
+	config.Settings.HostRateLimit = hostRate
+	config.Settings.RateLimitBurst = 1
+	savedLimiter := rateLimiter
+	t.Cleanup(func() { rateLimiter = savedLimiter })
+	rateLimiter = newRateLimiter()
+
+	// 先开始的检测阻塞到同一时刻结束，同时空出的检测名额不能让已等到令牌的检测一起发出
+	upstream := &fakeUpstream{exitIP: "203.0.113.7", exitGate: make(chan struct{})}
+	proxyURL := startHTTPProxy(t, upstream)
+	time.AfterFunc(300*time.Millisecond, func() { close(upstream.exitGate) })
+
+	proxiesChan := make(chan *ProxyInfo)
+	go func() {
+		defer close(proxiesChan)
+		for i := 0; i < total; i++ {
+			proxiesChan <- &ProxyInfo{URL: proxyURL, Protocol: "http", Source: fmt.Sprint(i)}
+		}
+	}()
+	pool := runProxyTests(t.Context(), proxiesChan)
+	for range pool.GetResults() {
+	}
+
+	hits := append([]time.Time{}, upstream.exitHits...)
+	if len(hits) != total {
+		t.Fatalf("检测目标收到 %d 个请求，期望 %d 个", len(hits), total)
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Before(hits[j]) })
+	minGap := time.Second / hostRate * 8 / 10
+	for i := 1; i < len(hits); i++ {
+		if gap := hits[i].Sub(hits[i-1]); gap < minGap {
+			t.Errorf("第 %d 个请求与上一个间隔 %v，小于限速间隔 %v", i+1, gap, minGap)
+		}
+	}
+}
+
+func TestLimitedReaderAllowsExactLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		entry     int64
+		total     int64
+		wantError bool
+	}{
+		{"恰好等于条目上限", 1024, 1024, 4096, false},
+		{"超出条目上限一个字节", 1025, 1024, 4096, true},
+		{"恰好用完总配额", 1024, 4096, 1024, false},
+		{"超出总配额一个字节", 1025, 4096, 1024, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := &archiveBudget{maxEntries: 1, maxEntryBytes: tt.entry, remaining: tt.total}
+			// 分小块读取，覆盖配额恰好用完后再次读取的情况
+			data, err := io.ReadAll(bufio.NewReaderSize(budget.open(strings.NewReader(strings.Repeat("x", tt.size))), 16))
+			if tt.wantError {
+				if err != errArchiveLimitExceeded {
+					t.Fatalf("err = %v, want %v", err, errArchiveLimitExceeded)
+				}
+				return
+			}
+			if err != nil || len(data) != tt.size {
+				t.Fatalf("读取 %d 字节, err = %v, want %d 字节", len(data), err, tt.size)
+			}
+			if budget.remaining != tt.total-int64(tt.size) {
+				t.Errorf("剩余配额 %d, want %d", budget.remaining, tt.total-int64(tt.size))
+			}
+		})
+	}
+}
+
+func TestCalculateProxyScoreDefaultReason(t *testing.T) {
+	saved := scoringModel
+	t.Cleanup(func() { scoringModel = saved })
+	scoringModel = defaultScoringModel()
+
+	// 默认模型的评分和说明与原有的固定评分一致
+	tests := []struct {
+		proxy      ProxyResult
+		wantScore  float64
+		wantReason string
+	}{
+		{
+			ProxyResult{URL: "socks5://u:p@198.51.100.1:1080", Protocol: "socks5_auth", Latency: 40, IPType: "residential", Country: "US"},
+			2610, "基础评分, 极佳延迟40.0ms+880.0, 住宅IP +500, USIP +80, SOCKS5 +150",
+		},
+		{
+			ProxyResult{URL: "http://198.51.100.2:8080", Protocol: "http", Latency: 200, IPType: "datacenter", IPDetails: "CN"},
+			1875, "基础评分, 良好延迟200.0ms+525.0, 数据中心IP +200, 中国IP +100, HTTP +50",
+		},
+		{
+			ProxyResult{URL: "https://secure.example.com:443", Protocol: "https", Latency: 700, IPType: "mobile", Country: "DE"},
+			1000 + 115 + 400 + 80 + 60, "基础评分, 高延迟700.0ms+115.0, 移动IP +400, HTTPS +80, 安全连接 +60",
+		},
+	}
+	for _, tt := range tests {
+		score := calculateProxyScore(tt.proxy)
+		if score.Score != tt.wantScore || score.Reason != tt.wantReason {
+			t.Errorf("%s: 得分 %.1f (%s), want %.1f (%s)", tt.proxy.URL, score.Score, score.Reason, tt.wantScore, tt.wantReason)
+		}
+	}
+}